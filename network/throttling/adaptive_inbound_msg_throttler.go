@@ -0,0 +1,314 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bufferToken identifies the specific buffer a throttler's Acquire handed
+// out, using the address of its backing array rather than its contents
+// (which the caller is free to mutate). The token doesn't depend on the
+// buffer's length, but Release still gives back len(buffer) bytes, so the
+// buffer must be passed back at the length Acquire returned. BufferPool
+// never hands out a buffer with zero capacity, so this is always safe to take.
+func bufferToken(buffer []byte) uintptr {
+	full := buffer[:cap(buffer)]
+	return uintptr(unsafe.Pointer(&full[0]))
+}
+
+var _ InboundMsgThrottler = &adaptiveInboundMsgThrottler{}
+
+// ewma is an exponentially-weighted moving average of a duration, e.g.
+// Acquire->Release latency, with a half-life expressed in samples rather
+// than wall-clock time: after [halfLifeSamples] observations, the weight
+// of any single earlier sample has halved.
+type ewma struct {
+	lock  sync.Mutex
+	alpha float64
+	value float64 // nanoseconds
+	set   bool
+}
+
+func newEWMA(halfLifeSamples float64) *ewma {
+	return &ewma{alpha: 1 - math.Exp(-math.Ln2/halfLifeSamples)}
+}
+
+// observe folds [sample] into the average and returns the updated value.
+func (e *ewma) observe(sample time.Duration) time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	s := float64(sample)
+	if !e.set {
+		e.value = s
+		e.set = true
+	} else {
+		e.value = e.alpha*s + (1-e.alpha)*e.value
+	}
+	return time.Duration(e.value)
+}
+
+// AdaptiveInboundMsgThrottlerConfig configures an adaptive inbound message
+// throttler on top of the usual byte/buffer/rate caps.
+type AdaptiveInboundMsgThrottlerConfig struct {
+	InboundMsgThrottlerConfig
+
+	// Target Acquire->Release processing latency. Global EWMA latency above
+	// this shrinks the at-large allocation; at or below it, the allocation
+	// grows back (additive increase / multiplicative decrease).
+	TargetLatency time.Duration `json:"targetLatency"`
+	// Number of samples over which an EWMA's weight on past samples halves.
+	EWMAHalfLifeSamples float64 `json:"ewmaHalfLifeSamples"`
+	// Fraction of TargetLatency used as a hysteresis band: the effective
+	// caps only change once the EWMA has moved past TargetLatency by more
+	// than this fraction, to avoid adjusting back and forth every sample.
+	HysteresisFraction float64 `json:"hysteresisFraction"`
+	// Multiplicative decrease factor (e.g. 0.9) applied to the at-large
+	// allocation when global EWMA latency is above target.
+	MultiplicativeDecreaseFactor float64 `json:"multiplicativeDecreaseFactor"`
+	// Bytes added back to the at-large allocation, capped at the
+	// configured AtLargeAllocSize, when global EWMA latency is at or below
+	// target (beyond the hysteresis band).
+	AdditiveIncreaseBytes uint64 `json:"additiveIncreaseBytes"`
+	// A node's own EWMA latency above target causes its effective
+	// NodeMaxAtLargeBytes to be reduced by this factor, independent of the
+	// global adjustment above.
+	NodeMultiplicativeDecreaseFactor float64 `json:"nodeMultiplicativeDecreaseFactor"`
+	// Floor under which a node's effective at-large cap won't be shrunk.
+	MinNodeMaxAtLargeBytes uint64 `json:"minNodeMaxAtLargeBytes"`
+}
+
+// NewAdaptiveInboundMsgThrottler returns an inbound message throttler that,
+// in addition to the fixed byte/buffer/rate caps of NewInboundMsgThrottler,
+// shrinks or grows its at-large allocation based on an EWMA of how long
+// messages take to process (Acquire->Release), both globally and per node.
+func NewAdaptiveInboundMsgThrottler(
+	log logging.Logger,
+	namespace string,
+	registerer prometheus.Registerer,
+	vdrs validators.Set,
+	config AdaptiveInboundMsgThrottlerConfig,
+) (InboundMsgThrottler, error) {
+	inner, err := NewInboundMsgThrottler(log, namespace, registerer, vdrs, config.InboundMsgThrottlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	effectiveAtLargeBytesMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "adaptive_throttler_effective_at_large_bytes",
+		Help:      "Current size of the at-large byte allocation, after AIMD adjustment",
+	})
+	globalLatencyMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "adaptive_throttler_global_latency_ewma_ms",
+		Help:      "EWMA of Acquire->Release latency across all nodes, in milliseconds",
+	})
+	errs := make([]error, 0, 2)
+	for _, c := range []prometheus.Collector{effectiveAtLargeBytesMetric, globalLatencyMetric} {
+		if err := registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("couldn't register adaptive throttler metrics: %v", errs)
+	}
+
+	t := &adaptiveInboundMsgThrottler{
+		inboundMsgThrottler:         inner.(*inboundMsgThrottler),
+		log:                         log,
+		config:                      config,
+		globalEWMA:                  newEWMA(config.EWMAHalfLifeSamples),
+		nodeEWMAs:                   make(map[ids.ShortID]*ewma),
+		starts:                      make(map[uintptr]time.Time),
+		effectiveAtLargeBytes:       config.AtLargeAllocSize,
+		effectiveAtLargeBytesMetric: effectiveAtLargeBytesMetric,
+		globalLatencyMetric:         globalLatencyMetric,
+	}
+	t.effectiveAtLargeBytesMetric.Set(float64(t.effectiveAtLargeBytes))
+	return t, nil
+}
+
+// adaptiveInboundMsgThrottler wraps an inboundMsgThrottler and adjusts its
+// at-large byte allocation (globally and per node) based on an EWMA of how
+// long messages take to process.
+type adaptiveInboundMsgThrottler struct {
+	*inboundMsgThrottler
+	log    logging.Logger
+	config AdaptiveInboundMsgThrottlerConfig
+
+	globalEWMA *ewma
+
+	lock      sync.Mutex
+	nodeEWMAs map[ids.ShortID]*ewma
+	// Acquisition token --> start time of that specific Acquire call. The
+	// token is the identity of the buffer Acquire returned, which is also
+	// what's passed back to Release, so a Release is always paired with
+	// its own Acquire regardless of order. Acquire order isn't release
+	// order here: a node can have more than one message in flight at once
+	// (MaxProcessingMsgsPerNode > 1), and priority scheduling can let a
+	// later-queued, higher-priority message release before an earlier one.
+	starts map[uintptr]time.Time
+
+	// Current size of the shared at-large allocation, which AIMD shrinks
+	// or grows between 0 and config.AtLargeAllocSize.
+	effectiveAtLargeBytes uint64
+
+	effectiveAtLargeBytesMetric prometheus.Gauge
+	globalLatencyMetric         prometheus.Gauge
+}
+
+func (t *adaptiveInboundMsgThrottler) Acquire(msgSize uint64, nodeID ids.ShortID) []byte {
+	start := time.Now()
+	buffer := t.inboundMsgThrottler.Acquire(msgSize, nodeID)
+	t.recordStart(buffer, start)
+	return buffer
+}
+
+func (t *adaptiveInboundMsgThrottler) AcquireWithPriority(msgSize uint64, nodeID ids.ShortID, op message.Op) []byte {
+	start := time.Now()
+	buffer := t.inboundMsgThrottler.AcquireWithPriority(msgSize, nodeID, op)
+	t.recordStart(buffer, start)
+	return buffer
+}
+
+func (t *adaptiveInboundMsgThrottler) Release(buffer []byte, nodeID ids.ShortID) {
+	// Pair this Release with its Acquire before handing the buffer back to
+	// the inner throttler (and, transitively, the buffer pool): once the
+	// pool can reissue the same backing array to a new Acquire, its token
+	// would collide with this one.
+	t.observeLatency(buffer, nodeID)
+	t.inboundMsgThrottler.Release(buffer, nodeID)
+}
+
+func (t *adaptiveInboundMsgThrottler) recordStart(buffer []byte, start time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.starts[bufferToken(buffer)] = start
+}
+
+// observeLatency pairs this Release with the Acquire that returned
+// [buffer], folds the resulting duration into the global and per-node
+// EWMAs, and re-derives the effective caps from them.
+func (t *adaptiveInboundMsgThrottler) observeLatency(buffer []byte, nodeID ids.ShortID) {
+	token := bufferToken(buffer)
+
+	t.lock.Lock()
+	start, ok := t.starts[token]
+	delete(t.starts, token)
+	nodeEWMA, ewmaOk := t.nodeEWMAs[nodeID]
+	if !ewmaOk {
+		nodeEWMA = newEWMA(t.config.EWMAHalfLifeSamples)
+		t.nodeEWMAs[nodeID] = nodeEWMA
+	}
+	t.lock.Unlock()
+
+	var elapsed time.Duration
+	if ok {
+		elapsed = time.Since(start)
+	}
+
+	nodeLatency := nodeEWMA.observe(elapsed)
+	globalLatency := t.globalEWMA.observe(elapsed)
+	t.globalLatencyMetric.Set(float64(globalLatency.Milliseconds()))
+
+	t.adjustGlobalCap(globalLatency)
+	t.adjustNodeCap(nodeID, nodeLatency)
+}
+
+// adjustGlobalCap applies AIMD to the shared at-large allocation: shrink
+// multiplicatively when the global EWMA is above target (beyond the
+// hysteresis band), grow additively when it's at or below target (beyond
+// the band), and otherwise leave it alone.
+func (t *adaptiveInboundMsgThrottler) adjustGlobalCap(latency time.Duration) {
+	band := time.Duration(float64(t.config.TargetLatency) * t.config.HysteresisFraction)
+	over := t.config.TargetLatency + band
+	under := t.config.TargetLatency - band
+
+	t.byteThrottler.lock.Lock()
+	defer t.byteThrottler.lock.Unlock()
+
+	current := t.effectiveAtLargeBytes
+	var next uint64
+	switch {
+	case latency > over:
+		next = uint64(float64(current) * t.config.MultiplicativeDecreaseFactor)
+	case latency <= under:
+		next = current + t.config.AdditiveIncreaseBytes
+		if next > t.config.AtLargeAllocSize {
+			next = t.config.AtLargeAllocSize
+		}
+	default:
+		return // within the hysteresis band; leave the cap where it is
+	}
+	if next == current {
+		return
+	}
+
+	if next > current {
+		delta := next - current
+		t.byteThrottler.remainingAtLargeBytes += delta
+		t.effectiveAtLargeBytes = next
+		t.effectiveAtLargeBytesMetric.Set(float64(next))
+		// Capacity just grew; messages already parked waiting for it
+		// shouldn't sit there until some unrelated Release wakes them.
+		t.byteThrottler.unblockWaitingMsgs()
+		return
+	}
+
+	delta := current - next
+	if delta > t.byteThrottler.remainingAtLargeBytes {
+		delta = t.byteThrottler.remainingAtLargeBytes
+		next = current - delta
+	}
+	t.byteThrottler.remainingAtLargeBytes -= delta
+	t.effectiveAtLargeBytes = next
+	t.effectiveAtLargeBytesMetric.Set(float64(next))
+}
+
+// adjustNodeCap reduces [nodeID]'s override of NodeMaxAtLargeBytes when its
+// own EWMA latency is above target, lets the override decay back to the
+// configured default when it's at or below target (beyond the hysteresis
+// band on either side), and otherwise leaves it alone.
+func (t *adaptiveInboundMsgThrottler) adjustNodeCap(nodeID ids.ShortID, latency time.Duration) {
+	band := time.Duration(float64(t.config.TargetLatency) * t.config.HysteresisFraction)
+	base := t.config.NodeMaxAtLargeBytes
+
+	t.byteThrottler.lock.Lock()
+	defer t.byteThrottler.lock.Unlock()
+
+	current, overridden := t.byteThrottler.nodeMaxAtLargeBytesOverride[nodeID]
+	if !overridden {
+		current = base
+	}
+
+	switch {
+	case latency > t.config.TargetLatency+band:
+		next := uint64(float64(current) * t.config.NodeMultiplicativeDecreaseFactor)
+		if next < t.config.MinNodeMaxAtLargeBytes {
+			next = t.config.MinNodeMaxAtLargeBytes
+		}
+		t.byteThrottler.nodeMaxAtLargeBytesOverride[nodeID] = next
+	case latency <= t.config.TargetLatency-band && current < base:
+		next := current + t.config.AdditiveIncreaseBytes
+		if next >= base {
+			delete(t.byteThrottler.nodeMaxAtLargeBytesOverride, nodeID)
+		} else {
+			t.byteThrottler.nodeMaxAtLargeBytesOverride[nodeID] = next
+		}
+		// [nodeID]'s cap just rose; wake anything of theirs parked waiting
+		// for room instead of leaving it for an unrelated Release to find.
+		t.byteThrottler.unblockWaitingMsgs()
+	}
+}
@@ -0,0 +1,108 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestAdaptiveThrottler(t *testing.T, config AdaptiveInboundMsgThrottlerConfig) *adaptiveInboundMsgThrottler {
+	t.Helper()
+	config.VdrAllocSize = 1 << 20
+	config.AtLargeAllocSize = 1 << 10
+	config.NodeMaxAtLargeBytes = 1 << 10
+	config.MaxMsgLen = 1 << 10
+	config.MaxBuffers = 16
+	config.MaxProcessingMsgsPerNode = 16
+	config.VdrMsgsPerSecond = 1e9
+	config.VdrBurst = 1e9
+	config.AtLargeMsgsPerSecond = 1e9
+	config.AtLargeBurst = 1e9
+
+	inner, err := NewAdaptiveInboundMsgThrottler(logging.NoLog{}, "test", prometheus.NewRegistry(), newFakeValidatorSet(), config)
+	if err != nil {
+		t.Fatalf("NewAdaptiveInboundMsgThrottler: %v", err)
+	}
+	return inner.(*adaptiveInboundMsgThrottler)
+}
+
+func TestAdjustGlobalCapHysteresis(t *testing.T) {
+	tr := newTestAdaptiveThrottler(t, AdaptiveInboundMsgThrottlerConfig{
+		TargetLatency:                100 * time.Millisecond,
+		HysteresisFraction:           0.2, // band: [80ms, 120ms]
+		MultiplicativeDecreaseFactor: 0.5,
+		AdditiveIncreaseBytes:        64,
+	})
+
+	const initial = 1 << 10
+
+	// Inside the band: no change.
+	tr.adjustGlobalCap(100 * time.Millisecond)
+	if tr.effectiveAtLargeBytes != initial {
+		t.Fatalf("latency within hysteresis band should not adjust the cap, got %d", tr.effectiveAtLargeBytes)
+	}
+
+	// Above the band: multiplicative decrease.
+	tr.adjustGlobalCap(200 * time.Millisecond)
+	if want := uint64(initial / 2); tr.effectiveAtLargeBytes != want {
+		t.Fatalf("latency above band should halve the cap, got %d want %d", tr.effectiveAtLargeBytes, want)
+	}
+
+	// At/under the band: additive increase.
+	tr.adjustGlobalCap(10 * time.Millisecond)
+	if want := uint64(initial/2 + 64); tr.effectiveAtLargeBytes != want {
+		t.Fatalf("latency under band should grow the cap additively, got %d want %d", tr.effectiveAtLargeBytes, want)
+	}
+}
+
+func TestAdjustGlobalCapNeverExceedsConfiguredMax(t *testing.T) {
+	tr := newTestAdaptiveThrottler(t, AdaptiveInboundMsgThrottlerConfig{
+		TargetLatency:                100 * time.Millisecond,
+		HysteresisFraction:           0.2,
+		MultiplicativeDecreaseFactor: 0.5,
+		AdditiveIncreaseBytes:        1 << 20, // one huge step should still clamp
+	})
+
+	// Shrink first so there's room to grow into.
+	tr.adjustGlobalCap(200 * time.Millisecond)
+	if tr.effectiveAtLargeBytes >= tr.config.AtLargeAllocSize {
+		t.Fatalf("expected the cap to have shrunk below the max, got %d", tr.effectiveAtLargeBytes)
+	}
+
+	tr.adjustGlobalCap(0)
+	if tr.effectiveAtLargeBytes != tr.config.AtLargeAllocSize {
+		t.Fatalf("cap should clamp to AtLargeAllocSize (%d), got %d", tr.config.AtLargeAllocSize, tr.effectiveAtLargeBytes)
+	}
+}
+
+// TestAcquireReleasePairsByToken exercises the fix for the FIFO-order bug:
+// releasing an out-of-order acquisition (e.g. a high-priority message that
+// finishes before an earlier, lower-priority one still in flight) must be
+// paired with its own start time, not whichever Acquire happened first.
+func TestAcquireReleasePairsByToken(t *testing.T) {
+	tr := newTestAdaptiveThrottler(t, AdaptiveInboundMsgThrottlerConfig{
+		TargetLatency:      100 * time.Millisecond,
+		HysteresisFraction: 0.2,
+	})
+	nodeID := ids.ShortID{1}
+
+	bufA := tr.Acquire(8, nodeID)
+	time.Sleep(5 * time.Millisecond)
+	bufB := tr.Acquire(8, nodeID)
+
+	// Release the second (younger) acquisition first.
+	tr.Release(bufB, nodeID)
+	if len(tr.starts) != 1 {
+		t.Fatalf("expected exactly bufA's start time left pending, got %d entries", len(tr.starts))
+	}
+	tr.Release(bufA, nodeID)
+	if len(tr.starts) != 0 {
+		t.Fatalf("expected no pending start times after both releases, got %d", len(tr.starts))
+	}
+}
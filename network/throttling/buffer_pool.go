@@ -0,0 +1,137 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/utils/units"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bufferSizeClasses are the power-of-two buffer sizes BufferPool pools.
+// Allocating in fixed classes, rather than exactly [msgSize] every time,
+// keeps the pool from fragmenting on odd sizes.
+var bufferSizeClasses = []uint64{
+	4 * units.KiB,
+	16 * units.KiB,
+	64 * units.KiB,
+	256 * units.KiB,
+	units.MiB,
+}
+
+// BufferPool hands out []byte buffers sized to a requested message, drawn
+// from a fixed set of power-of-two size classes, and caps the number of
+// buffers outstanding at once with a semaphore. A message can't be admitted
+// unless a buffer slot is actually available, tying admission control to
+// real memory ownership instead of just a byte counter.
+type BufferPool struct {
+	maxMsgLen uint64
+	// One sync.Pool per entry in bufferSizeClasses, plus one of maxMsgLen
+	// sized buffers (maxMsgLen may not be a power of two) for messages
+	// larger than the largest class.
+	pools []sync.Pool
+	// Bounds the total number of buffers handed out at once.
+	sem chan struct{}
+
+	lock           sync.Mutex
+	allocatedBytes uint64
+
+	allocatedBytesMetric prometheus.Gauge
+	inUseBuffersMetric   prometheus.Gauge
+	maxBuffersMetric     prometheus.Gauge
+}
+
+// NewBufferPool returns a pool that hands out buffers up to [maxMsgLen]
+// bytes long, with at most [maxBuffers] outstanding at any time.
+func NewBufferPool(
+	maxMsgLen uint64,
+	maxBuffers uint64,
+	namespace string,
+	registerer prometheus.Registerer,
+) (*BufferPool, error) {
+	classes := append(append([]uint64{}, bufferSizeClasses...), maxMsgLen)
+	p := &BufferPool{
+		maxMsgLen: maxMsgLen,
+		pools:     make([]sync.Pool, len(classes)),
+		sem:       make(chan struct{}, maxBuffers),
+		allocatedBytesMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "buffer_pool_allocated_bytes",
+			Help:      "Bytes currently held by buffers checked out of the buffer pool",
+		}),
+		inUseBuffersMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "buffer_pool_inuse_buffers",
+			Help:      "Number of buffers currently checked out of the buffer pool",
+		}),
+		maxBuffersMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "buffer_pool_max_buffers",
+			Help:      "Max number of buffers the buffer pool will hand out at once",
+		}),
+	}
+	for i, class := range classes {
+		class := class
+		p.pools[i].New = func() interface{} {
+			return make([]byte, class)
+		}
+	}
+	errs := make([]error, 0, 3)
+	for _, c := range []prometheus.Collector{p.allocatedBytesMetric, p.inUseBuffersMetric, p.maxBuffersMetric} {
+		if err := registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("couldn't register buffer pool metrics: %v", errs)
+	}
+	p.maxBuffersMetric.Set(float64(maxBuffers))
+	return p, nil
+}
+
+// classFor returns the index into [p.pools] of the smallest class that
+// can hold [size] bytes.
+func (p *BufferPool) classFor(size uint64) int {
+	for i, class := range bufferSizeClasses {
+		if size <= class {
+			return i
+		}
+	}
+	// Falls through to the maxMsgLen class, the last entry in p.pools.
+	return len(p.pools) - 1
+}
+
+// Get blocks until a buffer slot is available, then returns a buffer of
+// length [size] (size <= maxMsgLen).
+func (p *BufferPool) Get(size uint64) []byte {
+	p.sem <- struct{}{}
+
+	class := p.classFor(size)
+	buf := p.pools[class].Get().([]byte)
+
+	p.lock.Lock()
+	p.allocatedBytes += uint64(cap(buf))
+	p.allocatedBytesMetric.Set(float64(p.allocatedBytes))
+	p.lock.Unlock()
+	p.inUseBuffersMetric.Inc()
+
+	return buf[:size]
+}
+
+// Put returns a buffer previously returned by Get to the pool.
+func (p *BufferPool) Put(buf []byte) {
+	full := buf[:cap(buf)]
+	class := p.classFor(uint64(cap(full)))
+
+	p.lock.Lock()
+	p.allocatedBytes -= uint64(cap(full))
+	p.allocatedBytesMetric.Set(float64(p.allocatedBytes))
+	p.lock.Unlock()
+	p.inUseBuffersMetric.Dec()
+
+	p.pools[class].Put(full)
+	<-p.sem
+}
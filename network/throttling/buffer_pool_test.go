@@ -0,0 +1,65 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/units"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBufferPoolClassFor(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want uint64
+	}{
+		{size: 1, want: 4 * units.KiB},
+		{size: 4 * units.KiB, want: 4 * units.KiB},
+		{size: 4*units.KiB + 1, want: 16 * units.KiB},
+		{size: 64 * units.KiB, want: 64 * units.KiB},
+		{size: units.MiB, want: units.MiB},
+	}
+	p, err := NewBufferPool(2*units.MiB, 8, "test_class_for", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewBufferPool: %v", err)
+	}
+	for _, tt := range tests {
+		buf := p.Get(tt.size)
+		if uint64(cap(buf)) != tt.want {
+			t.Errorf("Get(%d): cap = %d, want %d", tt.size, cap(buf), tt.want)
+		}
+		if uint64(len(buf)) != tt.size {
+			t.Errorf("Get(%d): len = %d, want %d", tt.size, len(buf), tt.size)
+		}
+		p.Put(buf)
+	}
+}
+
+func TestBufferPoolBoundsOutstandingBuffers(t *testing.T) {
+	p, err := NewBufferPool(units.KiB, 1, "test_bounds", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewBufferPool: %v", err)
+	}
+
+	buf := p.Get(units.KiB)
+
+	done := make(chan []byte)
+	go func() { done <- p.Get(units.KiB) }()
+
+	select {
+	case <-done:
+		t.Fatal("Get should have blocked: only 1 buffer is allowed outstanding")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.Put(buf)
+	select {
+	case second := <-done:
+		p.Put(second)
+	case <-time.After(time.Second):
+		t.Fatal("Get should have unblocked once the first buffer was returned")
+	}
+}
@@ -0,0 +1,166 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+// commonMsgThrottler holds the byte accounting shared by the inbound and
+// outbound message throttlers: a fixed allocation reserved for validators
+// and a separate allocation shared by all other ("at-large") peers.
+type commonMsgThrottler struct {
+	lock sync.Mutex
+	log  logging.Logger
+	vdrs validators.Set
+
+	// Max number of bytes that can be taken from the validator allocation.
+	maxVdrBytes uint64
+	// Number of bytes left in the validator allocation.
+	remainingVdrBytes uint64
+	// Node ID --> this validator's share of maxVdrBytes, proportional to its
+	// stake weight. Recomputed whenever the validator set changes. A node
+	// absent from this map (not a current validator) gets none of the
+	// validator allocation.
+	nodeMaxVdrBytes map[ids.ShortID]uint64
+	// Number of bytes left in the at-large allocation.
+	remainingAtLargeBytes uint64
+	// Max number of bytes a given node can take from the at-large allocation.
+	nodeMaxAtLargeBytes uint64
+	// Node ID --> override of nodeMaxAtLargeBytes for that node specifically,
+	// e.g. a temporary reduction applied by an adaptive throttler. A node
+	// absent from this map uses nodeMaxAtLargeBytes.
+	nodeMaxAtLargeBytesOverride map[ids.ShortID]uint64
+
+	// Node ID --> Number of bytes this node has taken from the validator allocation.
+	nodeToVdrBytesUsed map[ids.ShortID]uint64
+	// Node ID --> Number of bytes this node has taken from the at-large allocation.
+	nodeToAtLargeBytesUsed map[ids.ShortID]uint64
+}
+
+// acquire attempts to take [msgSize] bytes for [nodeID] from the validator
+// allocation first, falling back to the at-large allocation for whatever
+// doesn't fit. Returns false if there isn't enough space in either
+// allocation to admit the message right now.
+//
+// Assumes [t.lock] is held.
+func (t *commonMsgThrottler) acquire(msgSize uint64, nodeID ids.ShortID) bool {
+	// See how much, if any, of [msgSize] can be taken from the validator allocation.
+	vdrBytesUsed := t.nodeToVdrBytesUsed[nodeID]
+	if isVdr, weight := t.vdrs.GetWeight(nodeID); isVdr && weight > 0 {
+		nodeMaxVdr := t.nodeMaxVdrBytes[nodeID]
+		availableToNode := uint64(0)
+		if nodeMaxVdr > vdrBytesUsed {
+			availableToNode = nodeMaxVdr - vdrBytesUsed
+		}
+		canTakeFromVdr := mathMin(msgSize, mathMin(t.remainingVdrBytes, availableToNode))
+		if canTakeFromVdr > 0 {
+			t.remainingVdrBytes -= canTakeFromVdr
+			t.nodeToVdrBytesUsed[nodeID] = vdrBytesUsed + canTakeFromVdr
+			msgSize -= canTakeFromVdr
+		}
+	}
+	if msgSize == 0 {
+		return true
+	}
+
+	// The rest has to come out of the at-large allocation, bounded by how
+	// much of the at-large allocation this node is allowed to use.
+	atLargeBytesUsed := t.nodeToAtLargeBytesUsed[nodeID]
+	nodeMax := t.nodeMaxAtLargeBytes
+	if override, ok := t.nodeMaxAtLargeBytesOverride[nodeID]; ok {
+		nodeMax = override
+	}
+	availableToNode := uint64(0)
+	if nodeMax > atLargeBytesUsed {
+		availableToNode = nodeMax - atLargeBytesUsed
+	}
+	canTakeAtLarge := mathMin(msgSize, mathMin(t.remainingAtLargeBytes, availableToNode))
+	if canTakeAtLarge < msgSize {
+		// Not enough room. Undo any validator bytes we provisionally took.
+		if taken := vdrBytesUsedDelta(t.nodeToVdrBytesUsed[nodeID], vdrBytesUsed); taken > 0 {
+			t.remainingVdrBytes += taken
+			t.nodeToVdrBytesUsed[nodeID] = vdrBytesUsed
+		}
+		return false
+	}
+	t.remainingAtLargeBytes -= canTakeAtLarge
+	t.nodeToAtLargeBytesUsed[nodeID] = atLargeBytesUsed + canTakeAtLarge
+	return true
+}
+
+// release gives back the bytes taken for a message of size [msgSize] from
+// [nodeID], returning validator bytes before at-large bytes.
+//
+// Assumes [t.lock] is held.
+func (t *commonMsgThrottler) release(msgSize uint64, nodeID ids.ShortID) {
+	vdrBytesUsed := t.nodeToVdrBytesUsed[nodeID]
+	if vdrBytesUsed > 0 {
+		given := mathMin(msgSize, vdrBytesUsed)
+		t.remainingVdrBytes += given
+		t.nodeToVdrBytesUsed[nodeID] = vdrBytesUsed - given
+		msgSize -= given
+	}
+	if msgSize == 0 {
+		return
+	}
+	atLargeBytesUsed := t.nodeToAtLargeBytesUsed[nodeID]
+	given := mathMin(msgSize, atLargeBytesUsed)
+	t.remainingAtLargeBytes += given
+	t.nodeToAtLargeBytesUsed[nodeID] = atLargeBytesUsed - given
+}
+
+// recomputeVdrAlloc recalculates each validator's share of maxVdrBytes,
+// proportional to its stake weight, and atomically swaps it in. Bytes a
+// node already has in use are left untouched: a node whose new share is
+// lower than its current usage simply can't acquire more until it releases.
+//
+// [vdrs] is snapshotted with List() under [t.lock], not by the caller, so
+// that two racing recomputes (e.g. the initial call racing a callback
+// fired by a concurrent validator-set change) can't have their writes land
+// in the opposite order from which their snapshots were taken: whichever
+// call acquires the lock first also reads the set first, so lock order and
+// snapshot recency always agree.
+func (t *commonMsgThrottler) recomputeVdrAlloc(vdrs validators.Set) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	list := vdrs.List()
+	totalWeight := uint64(0)
+	for _, vdr := range list {
+		totalWeight += vdr.Weight
+	}
+	next := make(map[ids.ShortID]uint64, len(list))
+	if totalWeight > 0 {
+		for _, vdr := range list {
+			// Compute as (maxVdrBytes * weight) / totalWeight without
+			// risking a uint64 overflow in the numerator: weights can be
+			// large enough (stake is denominated in nAVAX) that the naive
+			// product overflows before the division shrinks it back down.
+			share := new(big.Int).Mul(big.NewInt(0).SetUint64(t.maxVdrBytes), big.NewInt(0).SetUint64(vdr.Weight))
+			share.Quo(share, big.NewInt(0).SetUint64(totalWeight))
+			next[vdr.NodeID] = share.Uint64()
+		}
+	}
+	t.nodeMaxVdrBytes = next
+}
+
+func mathMin(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func vdrBytesUsedDelta(after, before uint64) uint64 {
+	if after > before {
+		return after - before
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+)
+
+// inboundMsgBufferThrottler rate-limits reading of inbound messages based
+// on the number of messages from a given node that we're currently processing.
+type inboundMsgBufferThrottler struct {
+	lock sync.Mutex
+	// Max number of messages from a single node that can be processed at once.
+	maxProcessingMsgsPerNode uint64
+	// Node ID --> Number of messages from that node currently being processed.
+	nodeToNumProcessingMsgs map[ids.ShortID]uint64
+	// Node ID --> Channels to close, in FIFO order, as slots free up for that node.
+	awaitingAcquire map[ids.ShortID][]chan struct{}
+}
+
+// Acquire blocks until there's room to process another message from [nodeID].
+func (t *inboundMsgBufferThrottler) Acquire(nodeID ids.ShortID) {
+	t.lock.Lock()
+	if t.nodeToNumProcessingMsgs[nodeID] < t.maxProcessingMsgsPerNode {
+		t.nodeToNumProcessingMsgs[nodeID]++
+		t.lock.Unlock()
+		return
+	}
+
+	done := make(chan struct{})
+	t.awaitingAcquire[nodeID] = append(t.awaitingAcquire[nodeID], done)
+	t.lock.Unlock()
+
+	<-done
+}
+
+// Release marks that we're done processing a message from [nodeID].
+func (t *inboundMsgBufferThrottler) Release(nodeID ids.ShortID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	waiters := t.awaitingAcquire[nodeID]
+	if len(waiters) == 0 {
+		if t.nodeToNumProcessingMsgs[nodeID] > 0 {
+			t.nodeToNumProcessingMsgs[nodeID]--
+		}
+		if t.nodeToNumProcessingMsgs[nodeID] == 0 {
+			delete(t.nodeToNumProcessingMsgs, nodeID)
+		}
+		return
+	}
+
+	// Hand the freed slot straight to the next waiter.
+	next := waiters[0]
+	t.awaitingAcquire[nodeID] = waiters[1:]
+	if len(t.awaitingAcquire[nodeID]) == 0 {
+		delete(t.awaitingAcquire, nodeID)
+	}
+	close(next)
+}
@@ -0,0 +1,94 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+)
+
+// inboundMsgByteThrottler rate-limits reading of inbound messages based on
+// the number of bytes being read from a given node.
+type inboundMsgByteThrottler struct {
+	commonMsgThrottler
+	metrics byteThrottlerMetrics
+
+	// Maps a message's op to the priority it should be served at. Messages
+	// waiting at a higher priority are admitted before lower-priority ones
+	// queued behind them on the same node.
+	priorityFunc MsgPriorityFunc
+
+	// Messages waiting for space on the byte throttler, scheduled fairly
+	// across nodes and by priority within a node.
+	waiting *fairMsgQueue
+}
+
+// Acquire blocks until [msgSize] bytes are available for [nodeID]. Requests
+// are scheduled as if their op were message.Op(0), at whatever priority
+// [t.priorityFunc] gives that op; use AcquireWithPriority when the message's
+// op is known.
+func (t *inboundMsgByteThrottler) Acquire(msgSize uint64, nodeID ids.ShortID) {
+	t.AcquireWithPriority(msgSize, nodeID, message.Op(0))
+}
+
+// AcquireWithPriority blocks until [msgSize] bytes are available for
+// [nodeID], scheduling [op]'s priority (per [t.priorityFunc]) against other
+// waiters from the same node.
+func (t *inboundMsgByteThrottler) AcquireWithPriority(msgSize uint64, nodeID ids.ShortID, op message.Op) {
+	t.lock.Lock()
+	if t.commonMsgThrottler.acquire(msgSize, nodeID) {
+		t.lock.Unlock()
+		return
+	}
+
+	priorityFunc := t.priorityFunc
+	if priorityFunc == nil {
+		priorityFunc = DefaultMsgPriority
+	}
+	msg := &waitingMsg{
+		nodeID:   nodeID,
+		msgSize:  msgSize,
+		op:       op,
+		priority: priorityFunc(op),
+		queuedAt: time.Now(),
+		done:     make(chan struct{}),
+	}
+	t.waiting.push(msg)
+	t.metrics.awaitingAcquire.Inc()
+	t.lock.Unlock()
+
+	<-msg.done
+}
+
+// Release gives back [msgSize] bytes that were acquired for [nodeID], and
+// wakes any waiters who can now be admitted.
+func (t *inboundMsgByteThrottler) Release(msgSize uint64, nodeID ids.ShortID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.commonMsgThrottler.release(msgSize, nodeID)
+	t.unblockWaitingMsgs()
+}
+
+// unblockWaitingMsgs admits as many waiting messages as currently fit,
+// scanning nodes fairly and serving each node's highest-priority waiter
+// first.
+//
+// Assumes [t.lock] is held.
+func (t *inboundMsgByteThrottler) unblockWaitingMsgs() {
+	for {
+		admitted := t.waiting.tryAdmitOne(func(msg *waitingMsg) bool {
+			return t.commonMsgThrottler.acquire(msg.msgSize, msg.nodeID)
+		})
+		if admitted == nil {
+			return
+		}
+		t.metrics.awaitingAcquire.Dec()
+		t.metrics.acquireLatency.Observe(float64(time.Since(admitted.queuedAt)))
+		t.metrics.observeWait(admitted.priority, time.Since(admitted.queuedAt))
+		close(admitted.done)
+	}
+}
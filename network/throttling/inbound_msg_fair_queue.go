@@ -0,0 +1,154 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+)
+
+// MsgPriorityFunc maps a message op to a priority level. Higher values are
+// served first within a node's queue. The default, returned by
+// DefaultMsgPriority, treats every op the same.
+type MsgPriorityFunc func(op message.Op) uint8
+
+// DefaultMsgPriority gives every message the same priority, i.e. FIFO
+// ordering within a node.
+func DefaultMsgPriority(message.Op) uint8 { return 0 }
+
+// waitingMsg is a message that's waiting for space on the byte throttler.
+type waitingMsg struct {
+	nodeID   ids.ShortID
+	msgSize  uint64
+	op       message.Op
+	priority uint8
+	// queuedAt is when this message started waiting.
+	queuedAt time.Time
+	// Closed when the message has acquired space.
+	done chan struct{}
+}
+
+// nodeWaitQueue holds a single node's waiting messages, bucketed by
+// priority. Within a bucket, messages are served FIFO.
+type nodeWaitQueue struct {
+	buckets map[uint8][]*waitingMsg
+	size    int
+}
+
+func newNodeWaitQueue() *nodeWaitQueue {
+	return &nodeWaitQueue{buckets: make(map[uint8][]*waitingMsg)}
+}
+
+func (q *nodeWaitQueue) push(msg *waitingMsg) {
+	q.buckets[msg.priority] = append(q.buckets[msg.priority], msg)
+	q.size++
+}
+
+// front returns the oldest message in the highest-priority non-empty bucket,
+// or nil if the node has no waiters.
+func (q *nodeWaitQueue) front() *waitingMsg {
+	best, ok := q.bestPriority()
+	if !ok {
+		return nil
+	}
+	return q.buckets[best][0]
+}
+
+// pop removes the message last returned by front().
+func (q *nodeWaitQueue) pop() {
+	best, ok := q.bestPriority()
+	if !ok {
+		return
+	}
+	q.buckets[best] = q.buckets[best][1:]
+	q.size--
+}
+
+func (q *nodeWaitQueue) bestPriority() (uint8, bool) {
+	best, found := uint8(0), false
+	for p, msgs := range q.buckets {
+		if len(msgs) == 0 {
+			continue
+		}
+		if !found || p > best {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+// fairMsgQueue is a two-tier scheduler for messages waiting to acquire space
+// on the byte throttler: a round-robin across nodeIDs, one turn per node
+// regardless of how many messages it has queued, so that one noisy peer
+// with many queued messages can't starve the others, and
+// within a node, a priority queue keyed by message op.
+type fairMsgQueue struct {
+	// Round-robin order of nodes that currently have at least one waiter.
+	order []ids.ShortID
+	nodes map[ids.ShortID]*nodeWaitQueue
+	// Index into [order] of the node to resume scanning from next.
+	cursor int
+	size   int
+}
+
+func newFairMsgQueue() *fairMsgQueue {
+	return &fairMsgQueue{nodes: make(map[ids.ShortID]*nodeWaitQueue)}
+}
+
+func (q *fairMsgQueue) len() int { return q.size }
+
+func (q *fairMsgQueue) push(msg *waitingMsg) {
+	nq, ok := q.nodes[msg.nodeID]
+	if !ok {
+		nq = newNodeWaitQueue()
+		q.nodes[msg.nodeID] = nq
+		q.order = append(q.order, msg.nodeID)
+	}
+	nq.push(msg)
+	q.size++
+}
+
+// tryAdmitOne scans nodes at most once each, in round-robin order starting
+// from the scheduler's cursor, and admits the highest-priority waiter of
+// the first node whose head message satisfies [admits]. Returns the
+// admitted message, or nil if none of the current waiters can be admitted.
+func (q *fairMsgQueue) tryAdmitOne(admits func(*waitingMsg) bool) *waitingMsg {
+	n := len(q.order)
+	for i := 0; i < n; i++ {
+		idx := (q.cursor + i) % n
+		nodeID := q.order[idx]
+		nq := q.nodes[nodeID]
+		msg := nq.front()
+		if msg == nil || !admits(msg) {
+			continue
+		}
+		nq.pop()
+		q.size--
+		q.cursor = (idx + 1) % n
+		q.removeNodeIfEmpty(nodeID)
+		return msg
+	}
+	return nil
+}
+
+// removeNodeIfEmpty drops [nodeID] from the round-robin order once it has
+// no more waiters, so it doesn't cost future scans an empty turn.
+func (q *fairMsgQueue) removeNodeIfEmpty(nodeID ids.ShortID) {
+	nq, ok := q.nodes[nodeID]
+	if !ok || nq.size > 0 {
+		return
+	}
+	delete(q.nodes, nodeID)
+	for i, id := range q.order {
+		if id == nodeID {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			if q.cursor > i {
+				q.cursor--
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+)
+
+func admitAll(*waitingMsg) bool { return true }
+
+func TestFairMsgQueueRoundRobinsAcrossNodes(t *testing.T) {
+	q := newFairMsgQueue()
+	nodeA := ids.ShortID{1}
+	nodeB := ids.ShortID{2}
+
+	q.push(&waitingMsg{nodeID: nodeA, priority: 0, done: make(chan struct{}), queuedAt: time.Now()})
+	q.push(&waitingMsg{nodeID: nodeA, priority: 0, done: make(chan struct{}), queuedAt: time.Now()})
+	q.push(&waitingMsg{nodeID: nodeB, priority: 0, done: make(chan struct{}), queuedAt: time.Now()})
+
+	// Even though A has two waiters queued back to back, B's single waiter
+	// must be served before A's second one: the scheduler is fair across
+	// nodes, not FIFO across the whole queue.
+	got := []ids.ShortID{}
+	for i := 0; i < 3; i++ {
+		msg := q.tryAdmitOne(admitAll)
+		if msg == nil {
+			t.Fatalf("expected a waiter at step %d", i)
+		}
+		got = append(got, msg.nodeID)
+	}
+	want := []ids.ShortID{nodeA, nodeB, nodeA}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("admit order = %v, want %v", got, want)
+		}
+	}
+	if msg := q.tryAdmitOne(admitAll); msg != nil {
+		t.Errorf("expected no more waiters, got one from %v", msg.nodeID)
+	}
+}
+
+func TestFairMsgQueuePrioritizesWithinNode(t *testing.T) {
+	q := newFairMsgQueue()
+	nodeID := ids.ShortID{1}
+
+	low := &waitingMsg{nodeID: nodeID, priority: 0, op: message.Op(1), done: make(chan struct{})}
+	high := &waitingMsg{nodeID: nodeID, priority: 5, op: message.Op(2), done: make(chan struct{})}
+	q.push(low)
+	q.push(high)
+
+	msg := q.tryAdmitOne(admitAll)
+	if msg != high {
+		t.Fatalf("expected higher-priority waiter first, got op %v", msg.op)
+	}
+	msg = q.tryAdmitOne(admitAll)
+	if msg != low {
+		t.Fatalf("expected lower-priority waiter second, got op %v", msg.op)
+	}
+}
+
+func TestFairMsgQueueSkipsNodeWhoseHeadCantBeAdmitted(t *testing.T) {
+	q := newFairMsgQueue()
+	nodeA := ids.ShortID{1}
+	nodeB := ids.ShortID{2}
+
+	blocked := &waitingMsg{nodeID: nodeA, priority: 0, done: make(chan struct{})}
+	ready := &waitingMsg{nodeID: nodeB, priority: 0, done: make(chan struct{})}
+	q.push(blocked)
+	q.push(ready)
+
+	admits := func(msg *waitingMsg) bool { return msg != blocked }
+	msg := q.tryAdmitOne(admits)
+	if msg != ready {
+		t.Fatalf("expected the admittable waiter to be served, got %v", msg)
+	}
+	if q.len() != 1 {
+		t.Errorf("blocked waiter should remain queued, len = %d", q.len())
+	}
+}
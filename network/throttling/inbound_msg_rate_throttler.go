@@ -0,0 +1,164 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gcraLimiter is a per-node rate limiter implementing the Generic Cell Rate
+// Algorithm. It admits a message of [cost] units if doing so would not push
+// the node's theoretical arrival time (tat) more than [burst] units past now.
+type gcraLimiter struct {
+	lock sync.Mutex
+
+	// Time between messages at the configured steady-state rate, i.e.
+	// 1s / msgsPerSecond (equivalently, period / burst).
+	emissionInterval time.Duration
+	// period is how far into the future a saturated bucket can schedule
+	// a message, i.e. burst * emissionInterval.
+	period time.Duration
+
+	// Node ID --> theoretical arrival time of that node's next message.
+	tat map[ids.ShortID]time.Time
+}
+
+func newGCRALimiter(msgsPerSecond float64, burst uint64) *gcraLimiter {
+	emissionInterval := time.Duration(float64(time.Second) / msgsPerSecond)
+	return &gcraLimiter{
+		emissionInterval: emissionInterval,
+		period:           emissionInterval * time.Duration(burst),
+		tat:              make(map[ids.ShortID]time.Time),
+	}
+}
+
+// reserve returns how long a message of [cost] from [nodeID] must wait to
+// be admitted at time [now], and reserves that slot by writing the node's
+// new tat before returning. Reserving at decision time, rather than only
+// after the caller has slept out the delay, is what makes this safe under
+// concurrent callers for the same node: each call sees the tat left by the
+// previous one, not a stale value every concurrent caller read at once.
+func (l *gcraLimiter) reserve(nodeID ids.ShortID, cost uint64, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	tat := l.tat[nodeID]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(l.emissionInterval * time.Duration(cost))
+	l.tat[nodeID] = newTAT
+
+	allowAt := newTAT.Add(-l.period)
+	if allowAt.After(now) {
+		return allowAt.Sub(now)
+	}
+	return 0
+}
+
+// rateThrottlerMetrics are the Prometheus counters for a GCRA rate limiter
+// bucket. There's no "rejected" counter: this limiter always admits a
+// message eventually by having the caller sleep out its reserved delay,
+// it never refuses one outright, so admitted+delayed is the complete set.
+type rateThrottlerMetrics struct {
+	admitted prometheus.Counter
+	delayed  prometheus.Counter
+}
+
+func newRateThrottlerMetrics(namespace, bucket string, registerer prometheus.Registerer) (rateThrottlerMetrics, error) {
+	m := rateThrottlerMetrics{
+		admitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      fmt.Sprintf("%s_rate_throttler_admitted", bucket),
+			Help:      fmt.Sprintf("Number of messages from %s admitted immediately by the rate throttler", bucket),
+		}),
+		delayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      fmt.Sprintf("%s_rate_throttler_delayed", bucket),
+			Help:      fmt.Sprintf("Number of messages from %s delayed by the rate throttler", bucket),
+		}),
+	}
+	errs := make([]error, 0, 2)
+	for _, c := range []prometheus.Collector{m.admitted, m.delayed} {
+		if err := registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return m, fmt.Errorf("couldn't register rate throttler metrics: %v", errs)
+	}
+	return m, nil
+}
+
+// MsgRateThrottlerConfig configures the per-node GCRA message-rate limiter.
+type MsgRateThrottlerConfig struct {
+	// Steady-state messages per second and burst allowance for validators.
+	VdrMsgsPerSecond float64 `json:"vdrMsgsPerSecond"`
+	VdrBurst         uint64  `json:"vdrBurst"`
+	// Steady-state messages per second and burst allowance for at-large (non-validator) peers.
+	AtLargeMsgsPerSecond float64 `json:"atLargeMsgsPerSecond"`
+	AtLargeBurst         uint64  `json:"atLargeBurst"`
+}
+
+// inboundMsgRateThrottler rate-limits inbound messages on a per-node basis
+// using GCRA, independently of how many bytes or buffer slots a message takes.
+// This bounds the rate at which a peer can send us tiny messages even when
+// it never exceeds the byte or buffer throttlers.
+type inboundMsgRateThrottler struct {
+	vdrs           validators.Set
+	vdrLimiter     *gcraLimiter
+	atLargeLimiter *gcraLimiter
+
+	vdrMetrics     rateThrottlerMetrics
+	atLargeMetrics rateThrottlerMetrics
+}
+
+func newInboundMsgRateThrottler(
+	vdrs validators.Set,
+	namespace string,
+	registerer prometheus.Registerer,
+	config MsgRateThrottlerConfig,
+) (*inboundMsgRateThrottler, error) {
+	vdrMetrics, err := newRateThrottlerMetrics(namespace, "vdr", registerer)
+	if err != nil {
+		return nil, err
+	}
+	atLargeMetrics, err := newRateThrottlerMetrics(namespace, "at_large", registerer)
+	if err != nil {
+		return nil, err
+	}
+	return &inboundMsgRateThrottler{
+		vdrs:           vdrs,
+		vdrLimiter:     newGCRALimiter(config.VdrMsgsPerSecond, config.VdrBurst),
+		atLargeLimiter: newGCRALimiter(config.AtLargeMsgsPerSecond, config.AtLargeBurst),
+		vdrMetrics:     vdrMetrics,
+		atLargeMetrics: atLargeMetrics,
+	}, nil
+}
+
+// Acquire blocks until [nodeID] is allowed to send another message under
+// the rate limit, sleeping if the node has exceeded its burst allowance.
+func (t *inboundMsgRateThrottler) Acquire(nodeID ids.ShortID) {
+	limiter, metrics := t.limiterFor(nodeID)
+	d := limiter.reserve(nodeID, 1, time.Now())
+	if d <= 0 {
+		metrics.admitted.Inc()
+		return
+	}
+	metrics.delayed.Inc()
+	time.Sleep(d)
+}
+
+func (t *inboundMsgRateThrottler) limiterFor(nodeID ids.ShortID) (*gcraLimiter, *rateThrottlerMetrics) {
+	if isVdr, weight := t.vdrs.GetWeight(nodeID); isVdr && weight > 0 {
+		return t.vdrLimiter, &t.vdrMetrics
+	}
+	return t.atLargeLimiter, &t.atLargeMetrics
+}
@@ -0,0 +1,76 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+)
+
+// TestGCRALimiterPacesConcurrentAcquires is the regression test for the
+// concurrent-Acquire bug: with burst exhausted, N concurrent reservations
+// for the same node must be paced emissionInterval apart, not all admitted
+// together at the same delay.
+func TestGCRALimiterPacesConcurrentAcquires(t *testing.T) {
+	const msgsPerSecond = 10.0 // 100ms emission interval
+	const burst = 1
+	l := newGCRALimiter(msgsPerSecond, burst)
+	nodeID := ids.ShortID{1}
+	now := time.Now()
+
+	// Exhaust the burst.
+	if d := l.reserve(nodeID, 1, now); d != 0 {
+		t.Fatalf("first reservation should be immediate, got delay %v", d)
+	}
+
+	const n = 5
+	delays := make([]time.Duration, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delays[i] = l.reserve(nodeID, 1, now)
+		}()
+	}
+	wg.Wait()
+
+	sum := make(map[time.Duration]int)
+	for _, d := range delays {
+		sum[d]++
+	}
+	if len(sum) != n {
+		t.Fatalf("expected %d distinct delays spaced %v apart, got %v", n, l.emissionInterval, delays)
+	}
+	for i := 1; i <= n; i++ {
+		want := l.emissionInterval * time.Duration(i)
+		if sum[want] != 1 {
+			t.Errorf("expected exactly one reservation at delay %v, got counts %v (delays: %v)", want, sum, delays)
+		}
+	}
+}
+
+// TestGCRALimiterAllowsBurstThenPaces checks the steady-state shape of the
+// algorithm: the first [burst] reservations are free, and the next one is
+// delayed by roughly emissionInterval.
+func TestGCRALimiterAllowsBurstThenPaces(t *testing.T) {
+	const msgsPerSecond = 100.0
+	const burst = 3
+	l := newGCRALimiter(msgsPerSecond, burst)
+	nodeID := ids.ShortID{2}
+	now := time.Now()
+
+	for i := 0; i < burst; i++ {
+		if d := l.reserve(nodeID, 1, now); d != 0 {
+			t.Errorf("reservation %d within burst should be immediate, got delay %v", i, d)
+		}
+	}
+	if d := l.reserve(nodeID, 1, now); d != l.emissionInterval {
+		t.Errorf("reservation past burst should be delayed by emissionInterval (%v), got %v", l.emissionInterval, d)
+	}
+}
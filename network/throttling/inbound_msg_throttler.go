@@ -5,8 +5,8 @@ package throttling
 
 import (
 	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
 	"github.com/ava-labs/avalanchego/snow/validators"
-	"github.com/ava-labs/avalanchego/utils/linkedhashmap"
 	"github.com/ava-labs/avalanchego/utils/logging"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -16,21 +16,41 @@ var (
 )
 
 // InboundMsgThrottler rate-limits inbound messages from the network.
+//
+// This package only implements the throttler itself; the network reader
+// loop that reads a message's length off the wire, calls Acquire for that
+// length, reads the message body directly into the returned buffer, and
+// calls Release when done, is not part of this tree and has not been
+// wired up to call it.
 type InboundMsgThrottler interface {
-	// Blocks until we can read a message of size [msgSize] from [nodeID].
-	// For every call to Acquire([msgSize], [nodeID]), we must (!) call
-	// Release([msgSize], [nodeID]) when done processing the message
+	// Blocks until we can read a message of size [msgSize] from [nodeID],
+	// then returns a buffer of that length to read the message into. For
+	// every call to Acquire([msgSize], [nodeID]), we must (!) call
+	// Release() with the returned buffer when done processing the message
 	// (or when we give up trying to read the message.)
-	Acquire(msgSize uint64, nodeID ids.ShortID)
+	Acquire(msgSize uint64, nodeID ids.ShortID) []byte
 
-	// Mark that we're done processing a message of size [msgSize]
-	// from [nodeID].
-	Release(msgSize uint64, nodeID ids.ShortID)
+	// Like Acquire, but schedules this message's wait against other
+	// waiters from [nodeID] according to [op]'s priority.
+	AcquireWithPriority(msgSize uint64, nodeID ids.ShortID, op message.Op) []byte
+
+	// Mark that we're done processing a message from [nodeID] and return
+	// [buffer], previously returned by Acquire or AcquireWithPriority, to
+	// the buffer pool.
+	Release(buffer []byte, nodeID ids.ShortID)
 }
 
 type InboundMsgThrottlerConfig struct {
 	MsgByteThrottlerConfig
+	MsgRateThrottlerConfig
 	MaxProcessingMsgsPerNode uint64 `json:"maxProcessingMsgsPerNode"`
+	// Maps a message op to the priority it's served at. If nil,
+	// DefaultMsgPriority is used and every op is treated the same.
+	MsgPriorityFunc MsgPriorityFunc `json:"-"`
+	// Largest message this throttler will ever be asked to Acquire space for.
+	MaxMsgLen uint64 `json:"maxMsgLen"`
+	// Max number of message buffers outstanding at once.
+	MaxBuffers uint64 `json:"maxBuffers"`
 }
 
 // Returns a new, sybil-safe inbound message throttler.
@@ -41,40 +61,56 @@ func NewInboundMsgThrottler(
 	vdrs validators.Set,
 	config InboundMsgThrottlerConfig,
 ) (InboundMsgThrottler, error) {
+	rateThrottler, err := newInboundMsgRateThrottler(vdrs, namespace, registerer, config.MsgRateThrottlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	bufferPool, err := NewBufferPool(config.MaxMsgLen, config.MaxBuffers, namespace, registerer)
+	if err != nil {
+		return nil, err
+	}
 	t := &inboundMsgThrottler{
 		byteThrottler: inboundMsgByteThrottler{
 			commonMsgThrottler: commonMsgThrottler{
-				log:                    log,
-				vdrs:                   vdrs,
-				maxVdrBytes:            config.VdrAllocSize,
-				remainingVdrBytes:      config.VdrAllocSize,
-				remainingAtLargeBytes:  config.AtLargeAllocSize,
-				nodeMaxAtLargeBytes:    config.NodeMaxAtLargeBytes,
-				nodeToVdrBytesUsed:     make(map[ids.ShortID]uint64),
-				nodeToAtLargeBytesUsed: make(map[ids.ShortID]uint64),
+				log:                         log,
+				vdrs:                        vdrs,
+				maxVdrBytes:                 config.VdrAllocSize,
+				remainingVdrBytes:           config.VdrAllocSize,
+				remainingAtLargeBytes:       config.AtLargeAllocSize,
+				nodeMaxAtLargeBytes:         config.NodeMaxAtLargeBytes,
+				nodeToVdrBytesUsed:          make(map[ids.ShortID]uint64),
+				nodeToAtLargeBytesUsed:      make(map[ids.ShortID]uint64),
+				nodeMaxAtLargeBytesOverride: make(map[ids.ShortID]uint64),
 			},
-			waitingToAcquire:    linkedhashmap.New(),
-			nodeToWaitingMsgIDs: make(map[ids.ShortID][]uint64),
+			priorityFunc: config.MsgPriorityFunc,
+			waiting:      newFairMsgQueue(),
 		},
 		bufferThrottler: inboundMsgBufferThrottler{
 			maxProcessingMsgsPerNode: config.MaxProcessingMsgsPerNode,
 			nodeToNumProcessingMsgs:  make(map[ids.ShortID]uint64),
 			awaitingAcquire:          make(map[ids.ShortID][]chan struct{}),
 		},
+		rateThrottler: rateThrottler,
+		bufferPool:    bufferPool,
 	}
+	registerVdrAlloc(vdrs, &t.byteThrottler.commonMsgThrottler)
 	return t, t.byteThrottler.metrics.initialize(namespace, registerer)
 }
 
 // A sybil-safe inbound message throttler.
 // Rate-limits reading of inbound messages to prevent peers from
 // consuming excess resources.
-// The two resources considered are:
-// 1. An inbound message buffer, where each message that we're currently
-//    processing takes up 1 unit of space on the buffer.
-// 2. An inbound message byte buffer, where a message of length n
-//    that we're currently processing takes up n units of space on the buffer.
+// The three resources considered are:
+//  1. An inbound message buffer, where each message that we're currently
+//     processing takes up 1 unit of space on the buffer.
+//  2. An inbound message byte buffer, where a message of length n
+//     that we're currently processing takes up n units of space on the buffer.
+//  3. A per-node message rate, enforced with GCRA, so that a peer that stays
+//     under the byte and buffer caps still can't flood us with tiny messages.
+//
 // A call to Acquire([msgSize], [nodeID]) blocks until we've secured
-// enough of both these resources to read a message of size [msgSize] from [nodeID].
+// enough of all three of these resources, and a free buffer slot from
+// [bufferPool], to read a message of size [msgSize] from [nodeID].
 type inboundMsgThrottler struct {
 	// Rate-limits based on number of messages from a given
 	// node that we're currently processing.
@@ -82,23 +118,47 @@ type inboundMsgThrottler struct {
 	// Rate-limits based on size of all messages from a given
 	// node that we're currently processing.
 	byteThrottler inboundMsgByteThrottler
+	// Rate-limits based on how many messages per second a given
+	// node has sent us, regardless of their size.
+	rateThrottler *inboundMsgRateThrottler
+	// Owns the buffer a message is read into; a message can't be admitted
+	// unless a buffer slot is actually available.
+	bufferPool *BufferPool
 }
 
-// Returns when we can read a message of size [msgSize] from node [nodeID].
-// Release([msgSize], [nodeID]) must be called (!) when done with the message
+// Returns when we can read a message of size [msgSize] from node [nodeID],
+// with a buffer of that length to read it into.
+// Release([buffer], [nodeID]) must be called (!) when done with the message
 // or when we give up trying to read the message, if applicable.
-func (t *inboundMsgThrottler) Acquire(msgSize uint64, nodeID ids.ShortID) {
+func (t *inboundMsgThrottler) Acquire(msgSize uint64, nodeID ids.ShortID) []byte {
 	// Acquire space on the inbound message buffer
 	t.bufferThrottler.Acquire(nodeID)
 	// Acquire space on the inbound message byte buffer
 	t.byteThrottler.Acquire(msgSize, nodeID)
+	// Acquire a slot in this node's message rate, pacing it via GCRA
+	t.rateThrottler.Acquire(nodeID)
+	// Check out a buffer sized to hold the message
+	return t.bufferPool.Get(msgSize)
+}
+
+// AcquireWithPriority is like Acquire, but lets [op]'s priority jump this
+// message ahead of lower-priority waiters already queued for [nodeID].
+// See InboundMsgThrottler interface.
+func (t *inboundMsgThrottler) AcquireWithPriority(msgSize uint64, nodeID ids.ShortID, op message.Op) []byte {
+	t.bufferThrottler.Acquire(nodeID)
+	t.byteThrottler.AcquireWithPriority(msgSize, nodeID, op)
+	t.rateThrottler.Acquire(nodeID)
+	return t.bufferPool.Get(msgSize)
 }
 
-// Must correspond to a previous call of Acquire([msgSize], [nodeID]).
+// Must correspond to a previous call of Acquire([msgSize], [nodeID]) or
+// AcquireWithPriority, passing back the buffer it returned.
 // See InboundMsgThrottler interface.
-func (t *inboundMsgThrottler) Release(msgSize uint64, nodeID ids.ShortID) {
+func (t *inboundMsgThrottler) Release(buffer []byte, nodeID ids.ShortID) {
 	// Release space on the inbound message buffer
 	t.bufferThrottler.Release(nodeID)
 	// Release space on the inbound message byte buffer
-	t.byteThrottler.Release(msgSize, nodeID)
+	t.byteThrottler.Release(uint64(len(buffer)), nodeID)
+	// Return the buffer to the pool
+	t.bufferPool.Put(buffer)
 }
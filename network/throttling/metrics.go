@@ -0,0 +1,54 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// byteThrottlerMetrics are the Prometheus metrics for a byte-based
+// message throttler.
+type byteThrottlerMetrics struct {
+	awaitingAcquire prometheus.Gauge
+	acquireLatency  prometheus.Histogram
+	// Time spent waiting to acquire space, labeled by the message's priority.
+	waitTimeByPriority *prometheus.HistogramVec
+}
+
+func (m *byteThrottlerMetrics) initialize(namespace string, registerer prometheus.Registerer) error {
+	m.awaitingAcquire = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "throttler_awaiting_acquire",
+		Help:      "Number of messages waiting to acquire space on the inbound message byte throttler",
+	})
+	m.acquireLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "throttler_acquire_latency",
+		Help:      "Time (in ns) a message waited to acquire space on the inbound message byte throttler",
+	})
+	m.waitTimeByPriority = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "throttler_queue_wait_time",
+		Help:      "Time (in seconds) a message waited in the byte throttler's queue, by priority",
+	}, []string{"priority"})
+	errs := make([]error, 0, 3)
+	for _, c := range []prometheus.Collector{m.awaitingAcquire, m.acquireLatency, m.waitTimeByPriority} {
+		if err := registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't register throttler metrics: %v", errs)
+	}
+	return nil
+}
+
+// observeWait records how long a message at [priority] waited in queue.
+func (m *byteThrottlerMetrics) observeWait(priority uint8, d time.Duration) {
+	m.waitTimeByPriority.WithLabelValues(strconv.Itoa(int(priority))).Observe(d.Seconds())
+}
@@ -0,0 +1,15 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+// MsgByteThrottlerConfig is the config for a byte-based message throttler.
+type MsgByteThrottlerConfig struct {
+	// Byte allocation size for all validators combined.
+	VdrAllocSize uint64 `json:"vdrAllocSize"`
+	// Byte allocation size for all non-validators combined.
+	AtLargeAllocSize uint64 `json:"atLargeAllocSize"`
+	// Max number of bytes that a given node, whether validator or
+	// not, can take from the at-large byte allocation.
+	NodeMaxAtLargeBytes uint64 `json:"nodeMaxAtLargeBytes"`
+}
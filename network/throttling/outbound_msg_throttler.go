@@ -0,0 +1,141 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ OutboundMsgThrottler = &outboundMsgThrottler{}
+
+// OutboundMsgThrottler rate-limits outbound messages to the network.
+// It's the write-side mirror of InboundMsgThrottler: byte and rate
+// accounting for messages we're about to send, rather than ones we've
+// received, plus a per-peer send queue with a configurable drop policy so
+// a slow or dead peer can't build an unbounded outbound backlog.
+//
+// This package only implements the throttler itself; the per-peer send
+// goroutine that calls EnqueueMsg/DequeueMsg to feed its writes, Acquire/
+// Release around each write, and RemoveQueue on disconnect, is not part of
+// this tree and has not been wired up to call it.
+type OutboundMsgThrottler interface {
+	// Blocks until we can send a message of size [msgSize] to [nodeID].
+	// For every call to Acquire([msgSize], [nodeID]), we must (!) call
+	// Release([msgSize], [nodeID]) once the message has been written
+	// (or we give up trying to send it.)
+	Acquire(msgSize uint64, nodeID ids.ShortID)
+
+	// Mark that we're done sending a message of size [msgSize] to [nodeID].
+	Release(msgSize uint64, nodeID ids.ShortID)
+
+	// EnqueueMsg attempts to admit a message of [msgSize] and op [op] onto
+	// [nodeID]'s send queue, applying [op]'s configured DropPolicy if the
+	// queue doesn't have room. Returns whether the message was admitted,
+	// and every already-queued message evicted to make room for it, if any.
+	EnqueueMsg(nodeID ids.ShortID, op message.Op, msgSize uint64) (bool, []*queuedOutboundMsg)
+
+	// DequeueMsg removes and returns the message at the front of [nodeID]'s
+	// send queue, if any.
+	DequeueMsg(nodeID ids.ShortID) (*queuedOutboundMsg, bool)
+
+	// RemoveQueue discards [nodeID]'s send queue entirely. Callers must
+	// invoke this on peer disconnect: without it, a node's queue is never
+	// freed, and a later reconnect under the same nodeID would otherwise
+	// start from whatever was left queued for the old connection instead
+	// of empty.
+	RemoveQueue(nodeID ids.ShortID)
+}
+
+type OutboundMsgThrottlerConfig struct {
+	MsgByteThrottlerConfig
+	MsgRateThrottlerConfig
+	// Max bytes, and max number of messages, a single peer's outbound send
+	// queue can hold before the configured DropPolicy kicks in.
+	PerPeerQueueBytes uint64 `json:"perPeerQueueBytes"`
+	PerPeerQueueMsgs  uint64 `json:"perPeerQueueMsgs"`
+	// Drop policy applied per message op when a peer's queue is full. An
+	// op absent from this map defaults to Block.
+	PolicyByOp map[message.Op]DropPolicy `json:"-"`
+	// Used by the DropByPriority policy to compare messages of different
+	// ops. If nil, DefaultMsgPriority is used and every op ranks the same.
+	MsgPriorityFunc MsgPriorityFunc `json:"-"`
+}
+
+// NewOutboundMsgThrottler returns a new outbound message throttler, the
+// write-side counterpart to NewInboundMsgThrottler.
+func NewOutboundMsgThrottler(
+	log logging.Logger,
+	namespace string,
+	registerer prometheus.Registerer,
+	vdrs validators.Set,
+	config OutboundMsgThrottlerConfig,
+) (OutboundMsgThrottler, error) {
+	rateThrottler, err := newInboundMsgRateThrottler(vdrs, namespace+"_outbound", registerer, config.MsgRateThrottlerConfig)
+	if err != nil {
+		return nil, err
+	}
+	sendQueueMetrics, err := newSendQueueMetrics(namespace+"_outbound", registerer)
+	if err != nil {
+		return nil, err
+	}
+	t := &outboundMsgThrottler{
+		byteThrottler: inboundMsgByteThrottler{
+			commonMsgThrottler: commonMsgThrottler{
+				log:                         log,
+				vdrs:                        vdrs,
+				maxVdrBytes:                 config.VdrAllocSize,
+				remainingVdrBytes:           config.VdrAllocSize,
+				remainingAtLargeBytes:       config.AtLargeAllocSize,
+				nodeMaxAtLargeBytes:         config.NodeMaxAtLargeBytes,
+				nodeToVdrBytesUsed:          make(map[ids.ShortID]uint64),
+				nodeToAtLargeBytesUsed:      make(map[ids.ShortID]uint64),
+				nodeMaxAtLargeBytesOverride: make(map[ids.ShortID]uint64),
+			},
+			waiting: newFairMsgQueue(),
+		},
+		rateThrottler:    rateThrottler,
+		config:           config,
+		priorityFunc:     config.MsgPriorityFunc,
+		sendQueues:       make(map[ids.ShortID]*peerSendQueue),
+		sendQueueMetrics: sendQueueMetrics,
+	}
+	registerVdrAlloc(vdrs, &t.byteThrottler.commonMsgThrottler)
+	return t, t.byteThrottler.metrics.initialize(namespace+"_outbound", registerer)
+}
+
+// outboundMsgThrottler rate-limits outbound messages by the same byte and
+// rate dimensions as inboundMsgThrottler, and gates writes to each peer's
+// send queue with a configurable drop policy. There's no buffer dimension:
+// we don't bound the number of outstanding writes to a node, only their
+// aggregate size, rate, and queued backlog.
+type outboundMsgThrottler struct {
+	byteThrottler inboundMsgByteThrottler
+	rateThrottler *inboundMsgRateThrottler
+
+	config       OutboundMsgThrottlerConfig
+	priorityFunc MsgPriorityFunc
+
+	queuesLock sync.Mutex
+	sendQueues map[ids.ShortID]*peerSendQueue
+
+	nextMsgIDLock sync.Mutex
+	nextMsgID     uint64
+
+	sendQueueMetrics sendQueueMetrics
+}
+
+func (t *outboundMsgThrottler) Acquire(msgSize uint64, nodeID ids.ShortID) {
+	t.byteThrottler.Acquire(msgSize, nodeID)
+	t.rateThrottler.Acquire(nodeID)
+}
+
+func (t *outboundMsgThrottler) Release(msgSize uint64, nodeID ids.ShortID) {
+	t.byteThrottler.Release(msgSize, nodeID)
+}
@@ -0,0 +1,258 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DropPolicy controls what EnqueueMsg does when a peer's outbound send
+// queue is already at its configured PerPeerQueueBytes/PerPeerQueueMsgs cap.
+type DropPolicy byte
+
+const (
+	// Block means the queue itself never drops anything; EnqueueMsg just
+	// reports that there's no room, and it's up to the caller (typically
+	// the peer's send goroutine) to wait and retry.
+	Block DropPolicy = iota
+	// DropNewest discards the message being enqueued and leaves the queue
+	// as it was.
+	DropNewest
+	// DropOldest evicts already-queued messages with the same op as the one
+	// being enqueued, oldest first, e.g. an obsolete Pull-Query superseded
+	// by a newer one, as many as it takes to make room.
+	DropOldest
+	// DropByPriority evicts queued messages of any op, lowest priority
+	// first, as many as it takes to make room, but only ones whose
+	// priority is no higher than the new message's.
+	DropByPriority
+)
+
+// queuedOutboundMsg is an outbound message waiting to be sent to a peer.
+type queuedOutboundMsg struct {
+	id       uint64
+	op       message.Op
+	msgSize  uint64
+	priority uint8
+}
+
+// peerSendQueue is the outbound queue for a single peer, in send order.
+type peerSendQueue struct {
+	lock  sync.Mutex
+	msgs  []*queuedOutboundMsg
+	bytes uint64
+}
+
+// sendQueueMetrics are the per-op Prometheus counters for the send queue.
+type sendQueueMetrics struct {
+	dropped *prometheus.CounterVec
+	evicted *prometheus.CounterVec
+}
+
+func newSendQueueMetrics(namespace string, registerer prometheus.Registerer) (sendQueueMetrics, error) {
+	m := sendQueueMetrics{
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "send_queue_dropped",
+			Help:      "Number of outbound messages dropped because a peer's send queue was full, by op",
+		}, []string{"op"}),
+		evicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "send_queue_evicted",
+			Help:      "Number of queued outbound messages evicted to make room for a newer one, by op",
+		}, []string{"op"}),
+	}
+	errs := make([]error, 0, 2)
+	for _, c := range []prometheus.Collector{m.dropped, m.evicted} {
+		if err := registerer.Register(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return m, fmt.Errorf("couldn't register send queue metrics: %v", errs)
+	}
+	return m, nil
+}
+
+// EnqueueMsg attempts to admit a message of [msgSize] and op [op] onto
+// [nodeID]'s outbound send queue. If the queue doesn't have room, the op's
+// configured DropPolicy (default Block) decides what happens: the new
+// message may be dropped, as many already-queued messages as it takes may
+// be evicted to make room for it, or admission may simply fail so the
+// caller can block.
+//
+// Returns whether the message was admitted, and every already-queued
+// message evicted to make room for it, if any.
+func (t *outboundMsgThrottler) EnqueueMsg(nodeID ids.ShortID, op message.Op, msgSize uint64) (bool, []*queuedOutboundMsg) {
+	priorityFunc := t.priorityFunc
+	if priorityFunc == nil {
+		priorityFunc = DefaultMsgPriority
+	}
+	priority := priorityFunc(op)
+
+	// No amount of eviction can ever make an over-cap message fit.
+	if msgSize > t.config.PerPeerQueueBytes {
+		t.sendQueueMetrics.dropped.WithLabelValues(op.String()).Inc()
+		return false, nil
+	}
+
+	q := t.queueFor(nodeID)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if fitsInQueue(q, t.config, msgSize) {
+		q.msgs = append(q.msgs, t.newQueuedMsg(op, msgSize, priority))
+		q.bytes += msgSize
+		return true, nil
+	}
+
+	switch t.config.PolicyByOp[op] {
+	case DropNewest:
+		t.sendQueueMetrics.dropped.WithLabelValues(op.String()).Inc()
+		return false, nil
+	case DropOldest:
+		toEvict, ok := planEviction(q, t.config, msgSize, func(m *queuedOutboundMsg) bool {
+			return m.op == op
+		})
+		if !ok {
+			t.sendQueueMetrics.dropped.WithLabelValues(op.String()).Inc()
+			return false, nil
+		}
+		evicted := evictFromQueue(q, toEvict)
+		t.sendQueueMetrics.evicted.WithLabelValues(op.String()).Add(float64(len(evicted)))
+		q.msgs = append(q.msgs, t.newQueuedMsg(op, msgSize, priority))
+		q.bytes += msgSize
+		return true, evicted
+	case DropByPriority:
+		toEvict, ok := planEviction(q, t.config, msgSize, func(m *queuedOutboundMsg) bool {
+			return m.priority <= priority
+		})
+		if !ok {
+			t.sendQueueMetrics.dropped.WithLabelValues(op.String()).Inc()
+			return false, nil
+		}
+		evicted := evictFromQueue(q, toEvict)
+		t.sendQueueMetrics.evicted.WithLabelValues(op.String()).Add(float64(len(evicted)))
+		q.msgs = append(q.msgs, t.newQueuedMsg(op, msgSize, priority))
+		q.bytes += msgSize
+		return true, evicted
+	default: // Block
+		return false, nil
+	}
+}
+
+// fitsInQueue reports whether [q] has room for another [msgSize] bytes
+// without exceeding [cfg]'s per-peer caps.
+func fitsInQueue(q *peerSendQueue, cfg OutboundMsgThrottlerConfig, msgSize uint64) bool {
+	return q.bytes+msgSize <= cfg.PerPeerQueueBytes && uint64(len(q.msgs))+1 <= cfg.PerPeerQueueMsgs
+}
+
+// planEviction greedily selects the fewest messages satisfying [evictable]
+// needed to make room for a new message of [msgSize] in [q], evicting the
+// lowest-priority eligible message first each round. Returns the indices to
+// evict, or ok=false if evicting every eligible message still wouldn't make
+// room, in which case nothing should be evicted.
+func planEviction(q *peerSendQueue, cfg OutboundMsgThrottlerConfig, msgSize uint64, evictable func(*queuedOutboundMsg) bool) ([]int, bool) {
+	bytes := q.bytes
+	count := uint64(len(q.msgs))
+	fits := func() bool { return bytes+msgSize <= cfg.PerPeerQueueBytes && count+1 <= cfg.PerPeerQueueMsgs }
+
+	evicted := make(map[int]bool)
+	var indices []int
+	for !fits() {
+		lowest := -1
+		for i, m := range q.msgs {
+			if evicted[i] || !evictable(m) {
+				continue
+			}
+			if lowest == -1 || m.priority < q.msgs[lowest].priority {
+				lowest = i
+			}
+		}
+		if lowest == -1 {
+			return nil, false
+		}
+		evicted[lowest] = true
+		indices = append(indices, lowest)
+		bytes -= q.msgs[lowest].msgSize
+		count--
+	}
+	return indices, true
+}
+
+// evictFromQueue removes the messages at [indices] from [q], adjusting
+// q.bytes, and returns them in their original queue order.
+func evictFromQueue(q *peerSendQueue, indices []int) []*queuedOutboundMsg {
+	if len(indices) == 0 {
+		return nil
+	}
+	remove := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		remove[i] = true
+	}
+	evicted := make([]*queuedOutboundMsg, 0, len(indices))
+	kept := make([]*queuedOutboundMsg, 0, len(q.msgs)-len(indices))
+	for i, m := range q.msgs {
+		if remove[i] {
+			evicted = append(evicted, m)
+			q.bytes -= m.msgSize
+			continue
+		}
+		kept = append(kept, m)
+	}
+	q.msgs = kept
+	return evicted
+}
+
+// DequeueMsg removes and returns the message at the front of [nodeID]'s
+// send queue, if any, for the send goroutine to actually write out.
+func (t *outboundMsgThrottler) DequeueMsg(nodeID ids.ShortID) (*queuedOutboundMsg, bool) {
+	q := t.queueFor(nodeID)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.msgs) == 0 {
+		return nil, false
+	}
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	q.bytes -= msg.msgSize
+	return msg, true
+}
+
+func (t *outboundMsgThrottler) queueFor(nodeID ids.ShortID) *peerSendQueue {
+	t.queuesLock.Lock()
+	defer t.queuesLock.Unlock()
+
+	q, ok := t.sendQueues[nodeID]
+	if !ok {
+		q = &peerSendQueue{}
+		t.sendQueues[nodeID] = q
+	}
+	return q
+}
+
+// RemoveQueue discards [nodeID]'s send queue. Must be called on peer
+// disconnect so a long-running node doesn't leak a peerSendQueue per
+// nodeID seen over its lifetime, and so a later reconnect under the same
+// nodeID starts with an empty queue instead of replaying whatever was
+// still queued for the old connection.
+func (t *outboundMsgThrottler) RemoveQueue(nodeID ids.ShortID) {
+	t.queuesLock.Lock()
+	defer t.queuesLock.Unlock()
+
+	delete(t.sendQueues, nodeID)
+}
+
+func (t *outboundMsgThrottler) newQueuedMsg(op message.Op, msgSize uint64, priority uint8) *queuedOutboundMsg {
+	t.nextMsgIDLock.Lock()
+	defer t.nextMsgIDLock.Unlock()
+	t.nextMsgID++
+	return &queuedOutboundMsg{id: t.nextMsgID, op: op, msgSize: msgSize, priority: priority}
+}
@@ -0,0 +1,144 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"testing"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/message"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestOutboundMsgThrottler(t *testing.T, config OutboundMsgThrottlerConfig) *outboundMsgThrottler {
+	t.Helper()
+	metrics, err := newSendQueueMetrics("test_send_queue", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("newSendQueueMetrics: %v", err)
+	}
+	return &outboundMsgThrottler{
+		config:           config,
+		priorityFunc:     config.MsgPriorityFunc,
+		sendQueues:       make(map[ids.ShortID]*peerSendQueue),
+		sendQueueMetrics: metrics,
+	}
+}
+
+// TestEnqueueMsgDropOldestNeverExceedsCap is the regression test for the
+// cap-overflow bug: evicting a single small message to make room for a much
+// larger one must not leave the queue over its configured byte cap. A 50B
+// message enqueued behind a 10B evictable message and 90B of other traffic,
+// with a 100B cap, must evict more than just the 10B message (or be
+// rejected outright), never land at 140B.
+func TestEnqueueMsgDropOldestNeverExceedsCap(t *testing.T) {
+	const queueCap = 100
+	evictableOp := message.Op(1)
+	otherOp := message.Op(2)
+	tr := newTestOutboundMsgThrottler(t, OutboundMsgThrottlerConfig{
+		PerPeerQueueBytes: queueCap,
+		PerPeerQueueMsgs:  10,
+		PolicyByOp:        map[message.Op]DropPolicy{evictableOp: DropOldest},
+	})
+	nodeID := ids.ShortID{1}
+
+	ok, evicted := tr.EnqueueMsg(nodeID, evictableOp, 10)
+	if !ok || len(evicted) != 0 {
+		t.Fatalf("expected the 10B message to be admitted with no eviction, got ok=%v evicted=%v", ok, evicted)
+	}
+	ok, evicted = tr.EnqueueMsg(nodeID, otherOp, 90)
+	if !ok || len(evicted) != 0 {
+		t.Fatalf("expected the 90B message to be admitted with no eviction, got ok=%v evicted=%v", ok, evicted)
+	}
+
+	ok, evicted = tr.EnqueueMsg(nodeID, evictableOp, 50)
+
+	q := tr.queueFor(nodeID)
+	q.lock.Lock()
+	bytes := q.bytes
+	q.lock.Unlock()
+	if bytes > queueCap {
+		t.Fatalf("queue holds %d bytes, over the %d byte cap (ok=%v evicted=%v)", bytes, queueCap, ok, evicted)
+	}
+	if ok && len(evicted) < 2 {
+		t.Errorf("a single evicted message can't make room for 50B under a 100B cap with 90B of non-evictable traffic already queued; evicted %v", evicted)
+	}
+}
+
+// TestEnqueueMsgRejectsMessageLargerThanCap checks the other half of the
+// fix: no amount of eviction can make an over-cap message fit, so it must
+// be rejected immediately rather than evicting the entire queue for nothing.
+func TestEnqueueMsgRejectsMessageLargerThanCap(t *testing.T) {
+	op := message.Op(1)
+	tr := newTestOutboundMsgThrottler(t, OutboundMsgThrottlerConfig{
+		PerPeerQueueBytes: 100,
+		PerPeerQueueMsgs:  10,
+		PolicyByOp:        map[message.Op]DropPolicy{op: DropOldest},
+	})
+	nodeID := ids.ShortID{1}
+
+	ok, evicted := tr.EnqueueMsg(nodeID, op, 150)
+	if ok || evicted != nil {
+		t.Fatalf("expected an over-cap message to be rejected outright, got ok=%v evicted=%v", ok, evicted)
+	}
+}
+
+// TestEnqueueMsgDropByPriorityRespectsCap mirrors the DropOldest regression
+// test for the DropByPriority policy, which shares the same planEviction
+// path.
+func TestEnqueueMsgDropByPriorityRespectsCap(t *testing.T) {
+	const queueCap = 100
+	low := message.Op(1)
+	high := message.Op(2)
+	tr := newTestOutboundMsgThrottler(t, OutboundMsgThrottlerConfig{
+		PerPeerQueueBytes: queueCap,
+		PerPeerQueueMsgs:  10,
+		PolicyByOp:        map[message.Op]DropPolicy{low: DropByPriority, high: DropByPriority},
+		MsgPriorityFunc: func(op message.Op) uint8 {
+			if op == high {
+				return 1
+			}
+			return 0
+		},
+	})
+	nodeID := ids.ShortID{1}
+
+	ok, _ := tr.EnqueueMsg(nodeID, low, 10)
+	if !ok {
+		t.Fatalf("expected the 10B low-priority message to be admitted")
+	}
+	ok, _ = tr.EnqueueMsg(nodeID, low, 90)
+	if !ok {
+		t.Fatalf("expected the 90B low-priority message to be admitted")
+	}
+
+	ok, evicted := tr.EnqueueMsg(nodeID, high, 50)
+
+	q := tr.queueFor(nodeID)
+	q.lock.Lock()
+	bytes := q.bytes
+	q.lock.Unlock()
+	if bytes > queueCap {
+		t.Fatalf("queue holds %d bytes, over the %d byte cap (ok=%v evicted=%v)", bytes, queueCap, ok, evicted)
+	}
+}
+
+// TestRemoveQueueDropsQueuedMessages checks the leak/replay fix: once a
+// node's queue is removed, a later message for the same nodeID starts from
+// empty instead of seeing whatever was queued for the prior connection.
+func TestRemoveQueueDropsQueuedMessages(t *testing.T) {
+	tr := newTestOutboundMsgThrottler(t, OutboundMsgThrottlerConfig{
+		PerPeerQueueBytes: 100,
+		PerPeerQueueMsgs:  10,
+	})
+	nodeID := ids.ShortID{1}
+
+	if ok, _ := tr.EnqueueMsg(nodeID, message.Op(1), 10); !ok {
+		t.Fatalf("expected the message to be admitted")
+	}
+	tr.RemoveQueue(nodeID)
+
+	if _, ok := tr.DequeueMsg(nodeID); ok {
+		t.Fatalf("expected no message left queued for %v after RemoveQueue", nodeID)
+	}
+}
@@ -0,0 +1,41 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/validators"
+)
+
+var _ validators.SetCallbackListener = (*vdrAllocListener)(nil)
+
+// vdrAllocListener keeps a commonMsgThrottler's stake-weighted validator
+// byte allocation (see recomputeVdrAlloc) in sync with [vdrs] as the
+// validator set changes.
+type vdrAllocListener struct {
+	vdrs validators.Set
+	t    *commonMsgThrottler
+}
+
+func (l *vdrAllocListener) OnValidatorAdded(ids.ShortID, uint64) { l.recompute() }
+
+func (l *vdrAllocListener) OnValidatorRemoved(ids.ShortID, uint64) { l.recompute() }
+
+func (l *vdrAllocListener) OnValidatorWeightChanged(_ ids.ShortID, _, _ uint64) { l.recompute() }
+
+func (l *vdrAllocListener) recompute() {
+	l.t.recomputeVdrAlloc(l.vdrs)
+}
+
+// registerVdrAlloc subscribes [t] to recompute its stake-weighted validator
+// byte allocation every time [vdrs] changes, then computes its initial
+// allocation from the set's current membership. Registering before the
+// initial recompute means a change racing with startup is never lost: it
+// either lands in the initial snapshot or arrives as a callback afterward.
+// recomputeVdrAlloc itself takes that snapshot under its own lock, so even
+// if both fire concurrently, they can't apply out of order.
+func registerVdrAlloc(vdrs validators.Set, t *commonMsgThrottler) {
+	vdrs.RegisterCallbackListener(&vdrAllocListener{vdrs: vdrs, t: t})
+	t.recomputeVdrAlloc(vdrs)
+}
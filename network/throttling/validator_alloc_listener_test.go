@@ -0,0 +1,174 @@
+// (c) 2021, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package throttling
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/validators"
+)
+
+// fakeValidatorSet implements the subset of validators.Set this package
+// depends on (List, GetWeight, RegisterCallbackListener), plus a setWeight
+// helper that updates the backing map and fires the same callbacks a real
+// Set would on add/remove/weight change, so it can drive vdrAllocListener
+// the same way production code does.
+type fakeValidatorSet struct {
+	lock      sync.Mutex
+	weights   map[ids.ShortID]uint64
+	listeners []validators.SetCallbackListener
+}
+
+func newFakeValidatorSet() *fakeValidatorSet {
+	return &fakeValidatorSet{weights: make(map[ids.ShortID]uint64)}
+}
+
+func (s *fakeValidatorSet) List() []validators.Validator {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]validators.Validator, 0, len(s.weights))
+	for nodeID, weight := range s.weights {
+		list = append(list, validators.Validator{NodeID: nodeID, Weight: weight})
+	}
+	return list
+}
+
+func (s *fakeValidatorSet) GetWeight(nodeID ids.ShortID) (bool, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	weight, ok := s.weights[nodeID]
+	return ok, weight
+}
+
+func (s *fakeValidatorSet) RegisterCallbackListener(listener validators.SetCallbackListener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.listeners = append(s.listeners, listener)
+}
+
+// setWeight adds, removes, or reweights [nodeID], then notifies every
+// registered listener the same way a real validators.Set would.
+func (s *fakeValidatorSet) setWeight(nodeID ids.ShortID, weight uint64) {
+	s.lock.Lock()
+	old, existed := s.weights[nodeID]
+	if weight == 0 {
+		delete(s.weights, nodeID)
+	} else {
+		s.weights[nodeID] = weight
+	}
+	listeners := make([]validators.SetCallbackListener, len(s.listeners))
+	copy(listeners, s.listeners)
+	s.lock.Unlock()
+
+	switch {
+	case !existed && weight > 0:
+		for _, l := range listeners {
+			l.OnValidatorAdded(nodeID, weight)
+		}
+	case existed && weight == 0:
+		for _, l := range listeners {
+			l.OnValidatorRemoved(nodeID, old)
+		}
+	case existed && weight != old:
+		for _, l := range listeners {
+			l.OnValidatorWeightChanged(nodeID, old, weight)
+		}
+	}
+}
+
+// TestVdrAllocUnderChurnAndTraffic exercises the race recomputeVdrAlloc's
+// lock-held snapshot closed: validator set churn (add/remove/reweight)
+// running concurrently with Acquire/Release traffic on the same throttler
+// must never leave the byte accounting inconsistent, no matter which
+// recompute happens to win the race.
+func TestVdrAllocUnderChurnAndTraffic(t *testing.T) {
+	nodeIDs := make([]ids.ShortID, 8)
+	for i := range nodeIDs {
+		nodeIDs[i] = ids.ShortID{byte(i + 1)}
+	}
+
+	vdrs := newFakeValidatorSet()
+	for i, nodeID := range nodeIDs[:4] {
+		vdrs.setWeight(nodeID, uint64(i+1))
+	}
+
+	const maxVdrBytes = 1 << 20
+	const maxAtLargeBytes = 1 << 20
+	ct := &commonMsgThrottler{
+		vdrs:                        vdrs,
+		maxVdrBytes:                 maxVdrBytes,
+		remainingVdrBytes:           maxVdrBytes,
+		remainingAtLargeBytes:       maxAtLargeBytes,
+		nodeMaxAtLargeBytes:         maxAtLargeBytes,
+		nodeToVdrBytesUsed:          make(map[ids.ShortID]uint64),
+		nodeToAtLargeBytesUsed:      make(map[ids.ShortID]uint64),
+		nodeMaxAtLargeBytesOverride: make(map[ids.ShortID]uint64),
+	}
+	registerVdrAlloc(vdrs, ct)
+
+	const rounds = 2000
+	var wg sync.WaitGroup
+
+	// Churn: repeatedly add, reweight, and remove validators, racing the
+	// registered vdrAllocListener's recomputes against each other.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			nodeID := nodeIDs[i%len(nodeIDs)]
+			vdrs.setWeight(nodeID, uint64(i%7)+1)
+		}
+	}()
+
+	// Traffic: Acquire/Release pairs on every node, racing the churn above.
+	for _, nodeID := range nodeIDs {
+		nodeID := nodeID
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				ct.lock.Lock()
+				acquired := ct.acquire(64, nodeID)
+				ct.lock.Unlock()
+				if !acquired {
+					continue
+				}
+				ct.lock.Lock()
+				ct.release(64, nodeID)
+				ct.lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// However churn landed, the byte accounting must still balance: every
+	// byte is either free or attributed to some node's usage. A recompute
+	// applied out of order wouldn't corrupt this directly, but it's exactly
+	// the kind of invariant a racing, half-applied allocation would be
+	// likely to violate under sustained concurrent traffic.
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	vdrUsed := uint64(0)
+	for _, used := range ct.nodeToVdrBytesUsed {
+		vdrUsed += used
+	}
+	if ct.remainingVdrBytes+vdrUsed != maxVdrBytes {
+		t.Errorf("vdr byte accounting inconsistent: remaining=%d used=%d want total=%d", ct.remainingVdrBytes, vdrUsed, uint64(maxVdrBytes))
+	}
+
+	atLargeUsed := uint64(0)
+	for _, used := range ct.nodeToAtLargeBytesUsed {
+		atLargeUsed += used
+	}
+	if ct.remainingAtLargeBytes+atLargeUsed != maxAtLargeBytes {
+		t.Errorf("at-large byte accounting inconsistent: remaining=%d used=%d want total=%d", ct.remainingAtLargeBytes, atLargeUsed, uint64(maxAtLargeBytes))
+	}
+}